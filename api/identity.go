@@ -0,0 +1,159 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+)
+
+// DuplicateIdentityError is returned when provider/providerID is already
+// linked to a different account, e.g. two users syncing the same phone
+// number.
+type DuplicateIdentityError struct {
+	Provider string
+}
+
+func (e DuplicateIdentityError) Error() string {
+	return fmt.Sprintf("An identity for provider %s is already linked to another account", e.Provider)
+}
+
+// createNewIdentity builds and persists an Identity for a user who did not
+// already have one for the given provider, e.g. a user who originally
+// signed up through OAuth or phone and is now attaching an email.
+func createNewIdentity(tx *storage.Connection, userID uuid.UUID, provider, providerID string, identityData map[string]interface{}) (*models.Identity, error) {
+	exists, err := models.IsDuplicatedIdentity(tx, provider, providerID)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, DuplicateIdentityError{Provider: provider}
+	}
+
+	identity, err := models.NewIdentity(userID, provider, providerID, identityData)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Create(identity); err != nil {
+		return nil, err
+	}
+
+	return identity, nil
+}
+
+// syncIdentity records a primary-contact change requested through
+// UserUpdate in the identities table, at request time and without changing
+// the users row: it updates the existing identity for provider if
+// the user already has one (e.g. they signed up with email/password), or
+// creates one if they don't (e.g. they signed up via Google and are now
+// setting an email for the first time). providerID is also used as the
+// identity's contact value since, for the "email"/"phone" providers, the
+// provider id and the contact value are the same string.
+func syncIdentity(tx *storage.Connection, userID uuid.UUID, provider, providerID string) error {
+	identity, err := models.FindIdentityByIDAndProvider(tx, userID, provider)
+	if err != nil {
+		if _, ok := err.(models.IdentityNotFoundError); ok {
+			_, err = createNewIdentity(tx, userID, provider, providerID, map[string]interface{}{
+				provider: providerID,
+			})
+			return err
+		}
+		return err
+	}
+
+	return identity.UpdateIdentityData(tx, map[string]interface{}{
+		provider: providerID,
+	})
+}
+
+// UserIdentitiesGet lists the identities linked to the authenticated user.
+// Mounted at GET /user/identities.
+func (a *API) UserIdentitiesGet(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	claims := getClaims(ctx)
+	userID, err := uuid.FromString(claims.Subject)
+	if err != nil {
+		return badRequestError("Could not read User ID claim")
+	}
+
+	identities, err := models.FindIdentitiesByUserID(a.db, userID)
+	if err != nil {
+		return internalServerError("Database error finding identities").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{
+		"identities": identities,
+	})
+}
+
+// UserIdentityDelete unlinks a single identity from the authenticated user.
+// Mounted at DELETE /user/identities/{id}. The last remaining identity
+// cannot be removed, since that would leave the account without any way to
+// authenticate.
+func (a *API) UserIdentityDelete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	claims := getClaims(ctx)
+	userID, err := uuid.FromString(claims.Subject)
+	if err != nil {
+		return badRequestError("Could not read User ID claim")
+	}
+
+	identityID, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		return badRequestError("Could not read identity id")
+	}
+
+	user, err := models.FindUserByID(a.db, userID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return notFoundError(err.Error())
+		}
+		return internalServerError("Database error finding user").WithInternalError(err)
+	}
+
+	instanceID := getInstanceID(ctx)
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		// Lock every identity row for this user before counting, so a
+		// concurrent delete against the same user's last two identities
+		// can't also observe count==2 and also proceed: the second
+		// transaction blocks on the lock until the first commits (or rolls
+		// back), then re-reads the now-current count.
+		identities, terr := models.LockIdentitiesByUserID(tx, userID)
+		if terr != nil {
+			return internalServerError("Database error finding identities").WithInternalError(terr)
+		}
+
+		if len(identities) <= 1 {
+			return unprocessableEntityError("Cannot remove the last identity on an account")
+		}
+
+		var target *models.Identity
+		for _, identity := range identities {
+			if identity.ID == identityID {
+				target = identity
+				break
+			}
+		}
+		if target == nil {
+			return notFoundError("Identity not found")
+		}
+
+		if terr := tx.Destroy(target); terr != nil {
+			return internalServerError("Database error removing identity").WithInternalError(terr)
+		}
+
+		return models.NewAuditLogEntry(tx, instanceID, user, models.IdentityRemovedAction, map[string]interface{}{
+			"identity_id": target.ID,
+			"provider":    target.Provider,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// TestUserIdentityDeleteRouteParam checks that chi.URLParam(r, "id"), the
+// lookup UserIdentityDelete uses, yields the {id} segment of a route shaped
+// like DELETE /user/identities/{id}. It uses a stand-in handler on its own
+// router; it does not call UserIdentityDelete or the API's router.
+func TestUserIdentityDeleteRouteParam(t *testing.T) {
+	identityID := uuid.Must(uuid.NewV4())
+
+	router := chi.NewRouter()
+	var gotErr error
+	var gotID uuid.UUID
+	router.Delete("/user/identities/{id}", func(w http.ResponseWriter, r *http.Request) {
+		gotID, gotErr = uuid.FromString(chi.URLParam(r, "id"))
+	})
+
+	req := httptest.NewRequest(http.MethodDelete, "/user/identities/"+identityID.String(), nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	require.NoError(t, gotErr)
+	require.Equal(t, identityID, gotID)
+}
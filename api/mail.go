@@ -0,0 +1,85 @@
+package api
+
+import (
+	"time"
+
+	"github.com/netlify/gotrue/mailer"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+)
+
+// sendReauthenticationNonce emails the signed-in user the nonce minted by
+// Reauthenticate so they can copy it back into the sensitive request
+// (password/email/phone change) that triggered it.
+func sendReauthenticationNonce(tx *storage.Connection, user *models.User, mailer mailer.Mailer, nonce string) error {
+	return mailer.ReauthenticateMail(user, nonce)
+}
+
+// sendPasswordRecovery issues a recovery token for user and emails the
+// plaintext to them, unless one was already sent within maxFrequency.
+// Passing a non-empty codeChallenge opts the token into the PKCE flow (see
+// models.CreateTokenWithChallenge); redemption at /recover/verify then
+// requires the matching code_verifier.
+func sendPasswordRecovery(tx *storage.Connection, user *models.User, mailer mailer.Mailer, maxFrequency time.Duration, referrerURL, codeChallenge string) error {
+	latest, err := models.LatestToken(tx, user.ID, models.RecoveryToken)
+	if err != nil {
+		if _, ok := err.(models.TokenNotFoundError); !ok {
+			return err
+		}
+	} else if time.Since(latest.CreatedAt) < maxFrequency {
+		return nil
+	}
+
+	_, plaintext, err := models.CreateTokenWithChallenge(tx, user.ID, models.RecoveryToken, nil, codeChallenge)
+	if err != nil {
+		return err
+	}
+
+	return mailer.RecoveryMail(user, plaintext, referrerURL)
+}
+
+// sendConfirmation issues a confirmation token for user and emails the
+// plaintext to them, unless one was already sent within maxFrequency.
+func sendConfirmation(tx *storage.Connection, user *models.User, mailer mailer.Mailer, maxFrequency time.Duration, referrerURL string) error {
+	latest, err := models.LatestToken(tx, user.ID, models.ConfirmationToken)
+	if err != nil {
+		if _, ok := err.(models.TokenNotFoundError); !ok {
+			return err
+		}
+	} else if time.Since(latest.CreatedAt) < maxFrequency {
+		return nil
+	}
+
+	_, plaintext, err := models.CreateToken(tx, user.ID, models.ConfirmationToken, nil)
+	if err != nil {
+		return err
+	}
+
+	return mailer.ConfirmationMail(user, plaintext, referrerURL)
+}
+
+// sendEmailChange issues an email-change token carrying newEmail as its
+// payload and emails the plaintext to that new address. It backs the
+// plain (non-double-opt-in) flow used when SecureEmailChangeEnabled is
+// unset. As with Recover, a non-empty codeChallenge opts the token into
+// the PKCE flow.
+func (a *API) sendEmailChange(tx *storage.Connection, user *models.User, mailer mailer.Mailer, newEmail, referrerURL, codeChallenge string) error {
+	_, plaintext, err := models.CreateTokenWithChallenge(tx, user.ID, models.EmailChangeToken, map[string]interface{}{"new_email": newEmail}, codeChallenge)
+	if err != nil {
+		return err
+	}
+
+	return mailer.EmailChangeMail(user, plaintext, newEmail, referrerURL)
+}
+
+// sendSecureEmailChange is like sendEmailChange but also emails a
+// confirmation to the user's current address, backing the double-opt-in
+// flow used when SecureEmailChangeEnabled is set.
+func (a *API) sendSecureEmailChange(tx *storage.Connection, user *models.User, mailer mailer.Mailer, newEmail, referrerURL, codeChallenge string) error {
+	_, plaintext, err := models.CreateTokenWithChallenge(tx, user.ID, models.EmailChangeToken, map[string]interface{}{"new_email": newEmail}, codeChallenge)
+	if err != nil {
+		return err
+	}
+
+	return mailer.SecureEmailChangeMail(user, plaintext, newEmail, referrerURL)
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+)
+
+// PKCEGrantParams are the params accepted by POST /token?grant_type=pkce.
+type PKCEGrantParams struct {
+	AuthCode     string `json:"auth_code"`
+	CodeVerifier string `json:"code_verifier"`
+}
+
+// PKCEGrant exchanges an auth code minted at the end of a PKCE-gated flow
+// (e.g. RecoverVerify) for a session, once the caller proves possession of
+// the code_verifier matching the challenge the code was issued with. It is
+// mounted at POST /token?grant_type=pkce, without requireAuthentication.
+func (a *API) PKCEGrant(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	params := &PKCEGrantParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read PKCE grant params: %v", err)
+	}
+
+	token, err := models.FindTokenByPlaintext(a.db, models.PKCEAuthCodeToken, params.AuthCode)
+	if err != nil {
+		if _, ok := err.(models.TokenNotFoundError); ok {
+			return badRequestError("Invalid auth code")
+		}
+		return internalServerError("Database error finding auth code").WithInternalError(err)
+	}
+
+	if token.IsExpired() {
+		return expiredTokenError("Auth code expired")
+	}
+
+	if !token.VerifyChallenge(params.CodeVerifier) {
+		return badRequestError("Invalid code_verifier")
+	}
+
+	user, err := models.FindUserByID(a.db, token.UserID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return notFoundError(err.Error())
+		}
+		return internalServerError("Database error finding user").WithInternalError(err)
+	}
+
+	var tokenResponse *AccessTokenResponse
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		if terr = token.Consume(tx); terr != nil {
+			if _, ok := terr.(models.TokenNotFoundError); ok {
+				return badRequestError("Auth code has already been used")
+			}
+			return internalServerError("Error consuming auth code").WithInternalError(terr)
+		}
+
+		tokenResponse, terr = a.issueRefreshToken(ctx, tx, user)
+		return terr
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, tokenResponse)
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limiterIdleTTL is how long a per-key bucket may sit unused before the
+// janitor reclaims it. It only needs to comfortably outlast burst/rate, not
+// track real session length.
+const limiterIdleTTL = 1 * time.Hour
+
+const limiterJanitorInterval = 10 * time.Minute
+
+// limiterClock lets tests inject a fake clock instead of time.Now, since
+// rate.Limiter itself has no seams for that.
+type limiterClock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// limiterEntry pairs a bucket with the last time it was touched, so the
+// janitor can tell which keys are stale.
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// sharedLimiter is a token-bucket rate limiter keyed by an arbitrary string
+// (typically "<instance_id>:<user_id>", falling back to the remote IP for
+// unauthenticated requests), shared across every mutating user endpoint so
+// that a single abusive caller can't exhaust the SMTP/SMS quota by hitting
+// several different routes.
+type sharedLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+	rate     rate.Limit
+	burst    int
+	clock    limiterClock
+}
+
+// newSharedLimiter builds a limiter allowing burst requests immediately and
+// refilling at r events/sec thereafter, per key.
+func newSharedLimiter(r rate.Limit, burst int) *sharedLimiter {
+	return &sharedLimiter{
+		limiters: map[string]*limiterEntry{},
+		rate:     r,
+		burst:    burst,
+		clock:    realClock{},
+	}
+}
+
+func (s *sharedLimiter) limiterFor(key string) *rate.Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	e, ok := s.limiters[key]
+	if !ok {
+		e = &limiterEntry{limiter: rate.NewLimiter(s.rate, s.burst)}
+		s.limiters[key] = e
+	}
+	e.lastSeen = now
+	return e.limiter
+}
+
+// Allow reports whether the request identified by key may proceed.
+func (s *sharedLimiter) Allow(key string) bool {
+	return s.limiterFor(key).AllowN(s.clock.Now(), 1)
+}
+
+// evictIdle removes buckets that haven't been touched in maxAge, so a
+// shared limiter with unbounded key cardinality (e.g. remote IPs) doesn't
+// grow without bound for the lifetime of the process.
+func (s *sharedLimiter) evictIdle(maxAge time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := s.clock.Now().Add(-maxAge)
+	for key, e := range s.limiters {
+		if e.lastSeen.Before(cutoff) {
+			delete(s.limiters, key)
+		}
+	}
+}
+
+// StartLimiterJanitor launches a goroutine that periodically evicts idle
+// buckets from limiter. It runs for the lifetime of the process; stop it by
+// closing done.
+func StartLimiterJanitor(limiter *sharedLimiter, done <-chan struct{}) {
+	ticker := time.NewTicker(limiterJanitorInterval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				limiter.evictIdle(limiterIdleTTL)
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// limiterKey derives the rate-limit bucket for a request: the
+// (instance_id, user_id) pair when the caller is authenticated, falling
+// back to the remote IP for the unauthenticated recovery flow.
+func limiterKey(r *http.Request) string {
+	ctx := r.Context()
+	instanceID := getInstanceID(ctx)
+
+	if claims := getClaims(ctx); claims != nil {
+		if claims.Subject != "" {
+			return instanceID.String() + ":" + claims.Subject
+		}
+	}
+
+	return instanceID.String() + ":" + remoteAddr(r)
+}
+
+// remoteAddr returns the client IP from the connection itself. It
+// deliberately ignores X-Forwarded-For: that header is client-supplied
+// unless a trusted reverse proxy config strips/overwrites it (which this
+// package has no way to verify), and trusting it would let any caller mint
+// a fresh rate-limit bucket per request just by varying the header.
+func remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitMutatingEndpoints returns chi middleware enforcing limiter against
+// every request, responding 429 with a Retry-After header when exceeded.
+// It is wired into the router for PUT /user, PUT /user/password,
+// POST /recover, POST /recover/verify and POST /user/resend-confirm.
+func (a *API) limitMutatingEndpoints(limiter *sharedLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !limiter.Allow(limiterKey(r)) {
+				w.Header().Set("Retry-After", strconv.Itoa(int(1/limiter.rate)+1))
+				handleError(tooManyRequestsError("Rate limit exceeded, please try again later"), w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
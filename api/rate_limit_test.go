@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestRemoteAddrIgnoresForwardedForHeader(t *testing.T) {
+	req := httptest.NewRequest("POST", "/recover", nil)
+	req.RemoteAddr = "203.0.113.9:51234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+	require.Equal(t, "203.0.113.9", remoteAddr(req))
+
+	// Varying the header on otherwise-identical requests must not change
+	// the derived key, or the limiter is trivially bypassable.
+	req.Header.Set("X-Forwarded-For", "9.9.9.9")
+	require.Equal(t, "203.0.113.9", remoteAddr(req))
+}
+
+func TestSharedLimiterEnforcesBurstThenBlocks(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	limiter := newSharedLimiter(1, 2)
+	limiter.clock = clock
+
+	require.True(t, limiter.Allow("key"))
+	require.True(t, limiter.Allow("key"))
+	require.False(t, limiter.Allow("key"), "burst of 2 should be exhausted on the 3rd call")
+
+	clock.now = clock.now.Add(2 * time.Second)
+	require.True(t, limiter.Allow("key"), "bucket should have refilled after waiting past the rate")
+}
+
+func TestSharedLimiterEvictsIdleKeys(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	limiter := newSharedLimiter(1, 1)
+	limiter.clock = clock
+
+	limiter.Allow("stale")
+	clock.now = clock.now.Add(2 * time.Hour)
+	limiter.Allow("fresh")
+
+	limiter.evictIdle(limiterIdleTTL)
+
+	limiter.mu.Lock()
+	_, staleStillPresent := limiter.limiters["stale"]
+	_, freshStillPresent := limiter.limiters["fresh"]
+	limiter.mu.Unlock()
+
+	require.False(t, staleStillPresent, "bucket idle past the TTL should be evicted")
+	require.True(t, freshStillPresent, "recently touched bucket should survive eviction")
+}
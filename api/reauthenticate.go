@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+)
+
+// Reauthenticate sends the signed-in user a short-lived, one-time nonce to
+// their current verified contact. It is mounted at GET /reauthenticate,
+// behind requireAuthentication, and is the first step of the reauthentication
+// gate: the caller must then echo the nonce back on the sensitive request
+// (password change, email change, phone change) for it to be honored.
+func (a *API) Reauthenticate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := getInstanceID(ctx)
+
+	claims := getClaims(ctx)
+	userID, err := uuid.FromString(claims.Subject)
+	if err != nil {
+		return badRequestError("Could not read User ID claim")
+	}
+
+	user, err := models.FindUserByID(a.db, userID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return notFoundError(err.Error())
+		}
+		return internalServerError("Database error finding user").WithInternalError(err)
+	}
+
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		_, nonce, terr := models.CreateNonce(tx, user.ID, models.ReauthenticationToken)
+		if terr != nil {
+			return internalServerError("Error generating reauthentication nonce").WithInternalError(terr)
+		}
+
+		mailer := a.Mailer(ctx)
+		if terr = sendReauthenticationNonce(tx, user, mailer, nonce); terr != nil {
+			return internalServerError("Error sending reauthentication nonce").WithInternalError(terr)
+		}
+
+		return models.NewAuditLogEntry(tx, instanceID, user, models.UserReauthenticateAction, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
+
+// verifyReauthentication consumes a pending reauthentication nonce for
+// user. Callers must run this, inside the same transaction as the change it
+// guards, before applying a password/email/phone update when
+// Security.ReauthenticationEnabled is set.
+func verifyReauthentication(tx *storage.Connection, instanceID uuid.UUID, user *models.User, nonce string) error {
+	token, err := models.FindTokenByPlaintext(tx, models.ReauthenticationToken, nonce)
+	if err != nil {
+		if _, ok := err.(models.TokenNotFoundError); ok {
+			models.NewAuditLogEntry(tx, instanceID, user, models.UserReauthenticateFailedAction, nil)
+			return badRequestError("Invalid reauthentication nonce")
+		}
+		return err
+	}
+
+	if token.UserID != user.ID || token.IsExpired() {
+		models.NewAuditLogEntry(tx, instanceID, user, models.UserReauthenticateFailedAction, nil)
+		return badRequestError("Invalid reauthentication nonce")
+	}
+
+	if err := token.Consume(tx); err != nil {
+		if _, ok := err.(models.TokenNotFoundError); ok {
+			models.NewAuditLogEntry(tx, instanceID, user, models.UserReauthenticateFailedAction, nil)
+			return badRequestError("Invalid reauthentication nonce")
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"time"
+
+	"github.com/netlify/gotrue/models"
+	"github.com/netlify/gotrue/storage"
+	"github.com/sirupsen/logrus"
+)
+
+const tokenJanitorInterval = 1 * time.Hour
+
+// StartTokenJanitor launches a goroutine that periodically deletes expired
+// rows from the tokens table. It runs for the lifetime of the process; stop
+// it by cancelling the provided channel.
+func StartTokenJanitor(db *storage.Connection, done <-chan struct{}) {
+	ticker := time.NewTicker(tokenJanitorInterval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := models.PurgeExpiredTokens(db); err != nil {
+					logrus.WithError(err).Error("error purging expired tokens")
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
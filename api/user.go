@@ -3,7 +3,6 @@ package api
 import (
 	"encoding/json"
 	"net/http"
-	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/netlify/gotrue/models"
@@ -17,6 +16,27 @@ type UserUpdateParams struct {
 	Data     map[string]interface{} `json:"data"`
 	AppData  map[string]interface{} `json:"app_metadata,omitempty"`
 	Phone    string                 `json:"phone"`
+	Nonce    string                 `json:"nonce"`
+	// CodeChallenge and CodeChallengeMethod opt an issued email-change
+	// token into the PKCE flow, the same way RecoverParams does for
+	// recovery tokens. Leave empty for the existing implicit flow.
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// requiresReauthentication reports whether params touches a field that, per
+// config, may not be changed without a fresh reauthentication nonce.
+func (params *UserUpdateParams) requiresReauthentication(user *models.User) bool {
+	if params.Password != nil {
+		return true
+	}
+	if params.Email != "" && params.Email != user.GetEmail() {
+		return true
+	}
+	if params.Phone != "" && params.Phone != user.GetPhone() {
+		return true
+	}
+	return false
 }
 
 // UserGet returns a user
@@ -61,6 +81,10 @@ func (a *API) UserUpdate(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("Could not read User Update params: %v", err)
 	}
 
+	if params.CodeChallenge != "" && params.CodeChallengeMethod != "S256" {
+		return badRequestError("code_challenge_method must be S256")
+	}
+
 	claims := getClaims(ctx)
 	userID, err := uuid.FromString(claims.Subject)
 	if err != nil {
@@ -80,6 +104,12 @@ func (a *API) UserUpdate(w http.ResponseWriter, r *http.Request) error {
 
 	err = a.db.Transaction(func(tx *storage.Connection) error {
 		var terr error
+		if config.Security.ReauthenticationEnabled && params.requiresReauthentication(user) {
+			if terr = verifyReauthentication(tx, instanceID, user, params.Nonce); terr != nil {
+				return terr
+			}
+		}
+
 		if params.Password != nil {
 			if len(*params.Password) < config.PasswordMinLength {
 				return invalidPasswordLengthError(config)
@@ -121,14 +151,30 @@ func (a *API) UserUpdate(w http.ResponseWriter, r *http.Request) error {
 			mailer := a.Mailer(ctx)
 			referrer := a.getReferrer(r)
 			if config.Mailer.SecureEmailChangeEnabled {
-				if terr = a.sendSecureEmailChange(tx, user, mailer, params.Email, referrer); terr != nil {
+				if terr = a.sendSecureEmailChange(tx, user, mailer, params.Email, referrer, params.CodeChallenge); terr != nil {
 					return internalServerError("Error sending change email").WithInternalError(terr)
 				}
 			} else {
-				if terr = a.sendEmailChange(tx, user, mailer, params.Email, referrer); terr != nil {
+				if terr = a.sendEmailChange(tx, user, mailer, params.Email, referrer, params.CodeChallenge); terr != nil {
 					return internalServerError("Error sending change email").WithInternalError(terr)
 				}
 			}
+
+			if terr = syncIdentity(tx, user.ID, "email", params.Email); terr != nil {
+				if _, ok := terr.(DuplicateIdentityError); ok {
+					return unprocessableEntityError(terr.Error())
+				}
+				return internalServerError("Error syncing email identity").WithInternalError(terr)
+			}
+		}
+
+		if params.Phone != "" && params.Phone != user.GetPhone() {
+			if terr = syncIdentity(tx, user.ID, "phone", params.Phone); terr != nil {
+				if _, ok := terr.(DuplicateIdentityError); ok {
+					return unprocessableEntityError(terr.Error())
+				}
+				return internalServerError("Error syncing phone identity").WithInternalError(terr)
+			}
 		}
 
 		if terr = models.NewAuditLogEntry(tx, instanceID, user, models.UserModifiedAction, nil); terr != nil {
@@ -144,12 +190,179 @@ func (a *API) UserUpdate(w http.ResponseWriter, r *http.Request) error {
 	return sendJSON(w, http.StatusOK, user)
 }
 
+// Recover sends a user a recovery link so they can regain access to their
+// account without being signed in. It is mounted at POST /recover.
+func (a *API) Recover(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	params := &RecoverParams{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	if err := jsonDecoder.Decode(params); err != nil {
+		return badRequestError("Could not read Recover params: %v", err)
+	}
+
+	if params.Email == "" {
+		return unprocessableEntityError("Password recovery requires an email")
+	}
+
+	aud := a.requestAud(ctx, r)
+	user, err := models.FindUserByEmailAndAudience(a.db, instanceID, params.Email, aud)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return notFoundError(err.Error())
+		}
+		return internalServerError("Database error finding user").WithInternalError(err)
+	}
+
+	if params.CodeChallenge != "" && params.CodeChallengeMethod != "S256" {
+		return badRequestError("code_challenge_method must be S256")
+	}
+
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		mailer := a.Mailer(ctx)
+		referrer := a.getReferrer(r)
+		if terr := sendPasswordRecovery(tx, user, mailer, config.SMTP.MaxFrequency, referrer, params.CodeChallenge); terr != nil {
+			return internalServerError("Error sending recovery mail").WithInternalError(terr)
+		}
+
+		return models.NewAuditLogEntry(tx, instanceID, user, models.UserRecoveryRequestedAction, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
+
+type RecoverParams struct {
+	Email string `json:"email"`
+	// CodeChallenge and CodeChallengeMethod opt the issued recovery token
+	// into the PKCE flow; when set, redemption at /recover/verify requires
+	// a matching code_verifier. Leave empty for the existing implicit flow.
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
 type ResetPasswordParams struct {
 	Password      string `json:"password"`
 	RecoveryToken string `json:"recovery_token"`
 }
 
+// RecoverVerifyParams are the params accepted by the unauthenticated
+// password reset endpoint.
+type RecoverVerifyParams struct {
+	RecoveryToken string `json:"recovery_token"`
+	Password      string `json:"password"`
+	// CodeVerifier is required when the recovery token was issued with a
+	// code_challenge; see models.Token.VerifyChallenge.
+	CodeVerifier string `json:"code_verifier"`
+}
+
+// RecoverVerify lets a user who has no session (because they forgot their
+// password in the first place) redeem the token mailed to them by Recover
+// and set a new password in one step. Unlike ResetPassword, it is mounted
+// at POST /recover/verify without requireAuthentication, and on success it
+// logs the caller in by returning a fresh access/refresh token pair. For a
+// recovery token issued with a code_challenge it returns an auth code
+// instead, to be exchanged through PKCEGrant.
+func (a *API) RecoverVerify(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.getConfig(ctx)
+	instanceID := getInstanceID(ctx)
+
+	params := &RecoverVerifyParams{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	if err := jsonDecoder.Decode(params); err != nil {
+		return badRequestError("Could not read Recover Verify params: %v", err)
+	}
+
+	if len(params.Password) < config.PasswordMinLength {
+		return invalidPasswordLengthError(config)
+	}
+
+	token, err := models.FindTokenByPlaintext(a.db, models.RecoveryToken, params.RecoveryToken)
+	if err != nil {
+		if _, ok := err.(models.TokenNotFoundError); ok {
+			return badRequestError("Could not match your recovery token")
+		}
+		return internalServerError("Database error finding recovery token").WithInternalError(err)
+	}
+
+	if token.IsExpired() {
+		return expiredTokenError("Recovery token expired")
+	}
+
+	if token.FlowType == models.FlowPKCE && params.CodeVerifier == "" {
+		return badRequestError("code_verifier is required to redeem this recovery token")
+	}
+
+	if !token.VerifyChallenge(params.CodeVerifier) {
+		return badRequestError("Invalid code_verifier")
+	}
+
+	user, err := models.FindUserByID(a.db, token.UserID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return notFoundError(err.Error())
+		}
+		return internalServerError("Database error finding user").WithInternalError(err)
+	}
+
+	var tokenResponse *AccessTokenResponse
+	var authCode string
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		if terr = token.Consume(tx); terr != nil {
+			if _, ok := terr.(models.TokenNotFoundError); ok {
+				return badRequestError("Recovery token has already been used")
+			}
+			return internalServerError("Error consuming recovery token").WithInternalError(terr)
+		}
+
+		if terr = user.Recover(tx); terr != nil {
+			return terr
+		}
+
+		if terr = user.UpdatePassword(tx, params.Password); terr != nil {
+			return internalServerError("Error during password storage").WithInternalError(terr)
+		}
+
+		if terr = models.NewAuditLogEntry(tx, instanceID, user, models.UserRecoveredAction, nil); terr != nil {
+			return internalServerError("Error recording audit log entry").WithInternalError(terr)
+		}
+
+		if token.FlowType == models.FlowPKCE {
+			// Hand back an auth code rather than a session; the caller
+			// exchanges it at POST /token?grant_type=pkce using the same
+			// code_verifier, matching the rest of the PKCE contract. It
+			// carries the same code_challenge as the recovery token and is
+			// a distinct, non-RecoverVerify-redeemable type, so obtaining
+			// it is useless without the verifier.
+			_, authCode, terr = models.CreateTokenWithChallenge(tx, user.ID, models.PKCEAuthCodeToken, nil, *token.CodeChallenge)
+			return terr
+		}
+
+		tokenResponse, terr = a.issueRefreshToken(ctx, tx, user)
+		return terr
+	})
+	if err != nil {
+		return err
+	}
+
+	if authCode != "" {
+		return sendJSON(w, http.StatusOK, map[string]string{"code": authCode})
+	}
+
+	return sendJSON(w, http.StatusOK, tokenResponse)
+}
+
 // reset password
+//
+// Deprecated: prefer RecoverVerify, which does not require an existing
+// session. ResetPassword stays unconditionally active for now for
+// backwards compatibility with callers still using the old flow.
 func (a *API) ResetPassword(w http.ResponseWriter, r *http.Request) error {
 
 	ctx := r.Context()
@@ -181,18 +394,32 @@ func (a *API) ResetPassword(w http.ResponseWriter, r *http.Request) error {
 		return internalServerError("Database error finding user").WithInternalError(err)
 	}
 
-	if params.RecoveryToken != user.RecoveryToken || user.RecoverySentAt == nil {
+	token, err := models.FindTokenByPlaintext(a.db, models.RecoveryToken, params.RecoveryToken)
+	if err != nil {
+		if _, ok := err.(models.TokenNotFoundError); ok {
+			return badRequestError("Could not match your recovery token")
+		}
+		return internalServerError("Database error finding recovery token").WithInternalError(err)
+	}
+
+	if token.UserID != user.ID {
 		return badRequestError("Could not match your recovery token")
 	}
 
-	nextDay := user.RecoverySentAt.Add(24 * time.Hour)
-	if time.Now().After(nextDay) {
+	if token.IsExpired() {
 		return expiredTokenError("Recovery token expired").WithInternalError(redirectWithQueryError)
 	}
 
 	err = a.db.Transaction(func(tx *storage.Connection) error {
 		var terr error
 
+		if terr = token.Consume(tx); terr != nil {
+			if _, ok := terr.(models.TokenNotFoundError); ok {
+				return badRequestError("Could not match your recovery token")
+			}
+			return internalServerError("Error consuming recovery token").WithInternalError(terr)
+		}
+
 		if terr = user.Recover(tx); terr != nil {
 			return terr
 		}
@@ -221,6 +448,7 @@ func (a *API) ResetPassword(w http.ResponseWriter, r *http.Request) error {
 type ChangePasswordParams struct {
 	CurrentPassword string `json:"current_password"`
 	Password        string `json:"password"`
+	Nonce           string `json:"nonce"`
 }
 
 // change password
@@ -258,6 +486,12 @@ func (a *API) ChangePassword(w http.ResponseWriter, r *http.Request) error {
 	err = a.db.Transaction(func(tx *storage.Connection) error {
 		var terr error
 		if params.Password != "" {
+			if config.Security.ReauthenticationEnabled {
+				if terr = verifyReauthentication(tx, instanceID, user, params.Nonce); terr != nil {
+					return terr
+				}
+			}
+
 			if len(params.Password) < config.PasswordMinLength {
 				return unprocessableEntityError(fmt.Sprintf("Password should be at least %d characters", config.PasswordMinLength))
 			}
@@ -0,0 +1,18 @@
+package models
+
+// Audit log action types introduced alongside the identities subsystem.
+// These live alongside (rather than in place of) the existing action
+// constants used by NewAuditLogEntry elsewhere in the package.
+const (
+	// IdentityRemovedAction is recorded when a user unlinks one of their
+	// identities via DELETE /user/identities/{id}.
+	IdentityRemovedAction = "identity_removed"
+
+	// UserReauthenticateAction is recorded when a reauthentication nonce is
+	// issued via GET /reauthenticate.
+	UserReauthenticateAction = "user_reauthenticate"
+
+	// UserReauthenticateFailedAction is recorded when a caller presents an
+	// invalid, expired or already-consumed reauthentication nonce.
+	UserReauthenticateFailedAction = "user_reauthenticate_failed"
+)
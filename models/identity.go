@@ -0,0 +1,136 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/storage"
+	"github.com/pkg/errors"
+)
+
+// Identity represents a single authentication factor belonging to a user:
+// their email, their phone number, or an OAuth provider account. A user can
+// accumulate several identities (e.g. sign up with Google, then also add an
+// email/password), which is what lets account linking collapse what used to
+// be duplicate `users` rows into one.
+type Identity struct {
+	ID           uuid.UUID       `json:"id" db:"id"`
+	UserID       uuid.UUID       `json:"user_id" db:"user_id"`
+	Provider     string          `json:"provider" db:"provider"`
+	ProviderID   string          `json:"-" db:"provider_id"`
+	IdentityData json.RawMessage `json:"identity_data" db:"identity_data"`
+	LastSignInAt *time.Time      `json:"last_sign_in_at,omitempty" db:"last_sign_in_at"`
+	CreatedAt    time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+// TableName satisfies pop's TableNameAble interface.
+func (Identity) TableName() string {
+	return "identities"
+}
+
+// FindIdentityByIDAndProvider looks up the identity a user has for a given
+// provider (e.g. ("email", user.ID) or ("google", user.ID)).
+func FindIdentityByIDAndProvider(tx *storage.Connection, userID uuid.UUID, provider string) (*Identity, error) {
+	identity := &Identity{}
+	err := tx.Where("user_id = ? and provider = ?", userID, provider).First(identity)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, IdentityNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "error finding identity")
+	}
+	return identity, nil
+}
+
+// FindIdentitiesByUserID returns every identity linked to a user, used to
+// populate GET /user/identities. The guard against deleting the last one
+// uses LockIdentitiesByUserID instead.
+func FindIdentitiesByUserID(tx *storage.Connection, userID uuid.UUID) ([]*Identity, error) {
+	identities := []*Identity{}
+	if err := tx.Where("user_id = ?", userID).Order("created_at asc").All(&identities); err != nil {
+		return nil, errors.Wrap(err, "error finding identities")
+	}
+	return identities, nil
+}
+
+// LockIdentitiesByUserID is FindIdentitiesByUserID plus a row-level lock on
+// every returned identity. A caller that reads the count to guard against
+// deleting a user's last identity must do so with this, inside the same
+// transaction as the delete, or two concurrent deletes can both observe
+// the pre-delete count and both proceed.
+func LockIdentitiesByUserID(tx *storage.Connection, userID uuid.UUID) ([]*Identity, error) {
+	identities := []*Identity{}
+	if err := tx.RawQuery("select * from identities where user_id = ? order by created_at asc for update", userID).All(&identities); err != nil {
+		return nil, errors.Wrap(err, "error locking identities")
+	}
+	return identities, nil
+}
+
+// IsDuplicatedIdentity reports whether provider/providerID is already
+// linked to some identity, e.g. two different users syncing the same
+// phone number. Callers should check this before Create rather than
+// relying on the unique index to reject it, so the caller can return a
+// normal user-facing error instead of a raw constraint violation.
+func IsDuplicatedIdentity(tx *storage.Connection, provider, providerID string) (bool, error) {
+	count, err := tx.Where("provider = ? and provider_id = ?", provider, providerID).Count(&Identity{})
+	if err != nil {
+		return false, errors.Wrap(err, "error checking identity uniqueness")
+	}
+	return count > 0, nil
+}
+
+// NewIdentity builds (without saving) an Identity for the given user,
+// provider and provider-scoped id, storing the rest of the provider's
+// profile payload in IdentityData.
+func NewIdentity(userID uuid.UUID, provider, providerID string, identityData map[string]interface{}) (*Identity, error) {
+	data, err := json.Marshal(identityData)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling identity data")
+	}
+
+	now := time.Now()
+	return &Identity{
+		ID:           uuid.Must(uuid.NewV4()),
+		UserID:       userID,
+		Provider:     provider,
+		ProviderID:   providerID,
+		IdentityData: data,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}, nil
+}
+
+// UpdateIdentityData merges the given keys into the identity's
+// IdentityData and persists the change.
+func (i *Identity) UpdateIdentityData(tx *storage.Connection, updates map[string]interface{}) error {
+	data := map[string]interface{}{}
+	if len(i.IdentityData) > 0 {
+		if err := json.Unmarshal(i.IdentityData, &data); err != nil {
+			return errors.Wrap(err, "error unmarshaling identity data")
+		}
+	}
+
+	for k, v := range updates {
+		data[k] = v
+	}
+
+	marshaled, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling identity data")
+	}
+
+	i.IdentityData = marshaled
+	i.UpdatedAt = time.Now()
+	return tx.UpdateOnly(i, "identity_data", "updated_at")
+}
+
+// IdentityNotFoundError is returned when a user has no identity for a given
+// provider.
+type IdentityNotFoundError struct{}
+
+func (e IdentityNotFoundError) Error() string {
+	return "Identity not found"
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+type IdentityTestSuite struct {
+	suite.Suite
+	db *storage.Connection
+}
+
+func TestIdentity(t *testing.T) {
+	ts := &IdentityTestSuite{db: db}
+	suite.Run(t, ts)
+}
+
+func (ts *IdentityTestSuite) SetupTest() {
+	ts.Require().NoError(ts.db.RawQuery("delete from identities").Exec())
+}
+
+// TestIsDuplicatedIdentity guards createNewIdentity's proactive check: a
+// provider_id already linked to some identity (e.g. two users syncing the
+// same phone number) must be reported before Create is attempted, rather
+// than surfacing as a raw unique-constraint violation.
+func (ts *IdentityTestSuite) TestIsDuplicatedIdentity() {
+	userID := uuid.Must(uuid.NewV4())
+
+	count, err := ts.db.Where("provider = ? and provider_id = ?", "phone", "+15555550100").Count(&Identity{})
+	ts.Require().NoError(err)
+	ts.Require().Equal(0, count)
+
+	dup, err := IsDuplicatedIdentity(ts.db, "phone", "+15555550100")
+	ts.Require().NoError(err)
+	ts.False(dup)
+
+	identity, err := NewIdentity(userID, "phone", "+15555550100", map[string]interface{}{"phone": "+15555550100"})
+	ts.Require().NoError(err)
+	ts.Require().NoError(ts.db.Create(identity))
+
+	dup, err = IsDuplicatedIdentity(ts.db, "phone", "+15555550100")
+	ts.Require().NoError(err)
+	ts.True(dup, "provider_id already linked to another identity should be reported")
+
+	// A different provider with the same provider_id string is a distinct
+	// identity, not a duplicate.
+	dup, err = IsDuplicatedIdentity(ts.db, "email", "+15555550100")
+	ts.Require().NoError(err)
+	ts.False(dup)
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"os"
+	"testing"
+
+	"github.com/netlify/gotrue/conf"
+	"github.com/netlify/gotrue/storage"
+	"github.com/netlify/gotrue/storage/test"
+)
+
+var db *storage.Connection
+
+func TestMain(m *testing.M) {
+	globalConfig, err := conf.LoadGlobal("../hack/test.env")
+	if err != nil {
+		panic(err)
+	}
+
+	conn, err := test.SetupDBConnection(globalConfig)
+	if err != nil {
+		panic(err)
+	}
+	db = conn
+
+	os.Exit(m.Run())
+}
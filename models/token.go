@@ -0,0 +1,276 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/storage"
+	"github.com/pkg/errors"
+)
+
+// TokenNotFoundError is returned by FindTokenByPlaintext when no unused token
+// matches, by LatestToken when the user has no token of that type, and by
+// Consume when the token has already been used.
+type TokenNotFoundError struct{}
+
+func (e TokenNotFoundError) Error() string {
+	return "Token not found"
+}
+
+// randomToken generates a URL-safe, cryptographically random token of
+// sufficient length that brute-forcing the plaintext behind a hash is
+// infeasible.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// TokenType discriminates the purpose a Token was issued for. Each type has
+// its own default TTL (see defaultTokenTTL) so that, for example, an invite
+// link can outlive a magic link without a schema change.
+type TokenType string
+
+const (
+	RecoveryToken         TokenType = "recovery"
+	EmailChangeToken      TokenType = "email_change"
+	ConfirmationToken     TokenType = "confirmation"
+	InviteToken           TokenType = "invite"
+	MagicLinkToken        TokenType = "magic_link"
+	ReauthenticationToken TokenType = "reauthentication"
+	// PKCEAuthCodeToken is the intermediate code handed back in place of a
+	// session when a PKCE-gated flow (e.g. RecoverVerify) completes. It is
+	// a distinct type from the token that produced it so it can only be
+	// redeemed through the PKCE exchange endpoint, never back through the
+	// flow's own verify endpoint.
+	PKCEAuthCodeToken TokenType = "pkce_auth_code"
+)
+
+var defaultTokenTTL = map[TokenType]time.Duration{
+	RecoveryToken:         24 * time.Hour,
+	EmailChangeToken:      24 * time.Hour,
+	ConfirmationToken:     24 * time.Hour,
+	InviteToken:           7 * 24 * time.Hour,
+	MagicLinkToken:        1 * time.Hour,
+	PKCEAuthCodeToken:     5 * time.Minute,
+	ReauthenticationToken: 5 * time.Minute,
+}
+
+// FlowType distinguishes a plain bearer-token redemption (FlowImplicit) from
+// one gated by a PKCE code_challenge/code_verifier pair (FlowPKCE), where
+// redemption yields an auth code to be exchanged at POST /token rather than
+// a session directly.
+type FlowType string
+
+const (
+	FlowImplicit FlowType = "implicit"
+	FlowPKCE     FlowType = "pkce"
+)
+
+// Token is a hashed, single-use credential handed out by the recovery,
+// email-change, confirmation, invite and magic-link flows. The plaintext
+// value is only ever returned to the caller at issuance time; everything
+// that is persisted and later looked up is the SHA-256 hash of it, so a
+// leaked database row is not itself redeemable.
+type Token struct {
+	ID            uuid.UUID  `json:"id" db:"id"`
+	TokenHash     string     `json:"-" db:"token_hash"`
+	Type          TokenType  `json:"type" db:"type"`
+	UserID        uuid.UUID  `json:"user_id" db:"user_id"`
+	Payload       string     `json:"-" db:"payload"`
+	FlowType      FlowType   `json:"flow_type" db:"flow_type"`
+	CodeChallenge *string    `json:"-" db:"code_challenge"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+	ExpiresAt     time.Time  `json:"expires_at" db:"expires_at"`
+	UsedAt        *time.Time `json:"used_at,omitempty" db:"used_at"`
+}
+
+// TableName satisfies pop's TableNameAble interface.
+func (Token) TableName() string {
+	return "tokens"
+}
+
+func hashToken(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateToken issues and persists a new token of the given type for user,
+// returning the model (for Payload/ExpiresAt access) and the plaintext
+// value that must be handed to the user out-of-band (e.g. in an email
+// link) since it is not recoverable from the stored row.
+func CreateToken(tx *storage.Connection, userID uuid.UUID, tokenType TokenType, payload interface{}) (*Token, string, error) {
+	plaintext, err := randomToken()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "error generating token")
+	}
+
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "error marshaling token payload")
+	}
+
+	now := time.Now()
+	token := &Token{
+		ID:        uuid.Must(uuid.NewV4()),
+		TokenHash: hashToken(plaintext),
+		Type:      tokenType,
+		UserID:    userID,
+		Payload:   string(payloadJSON),
+		FlowType:  FlowImplicit,
+		CreatedAt: now,
+		ExpiresAt: now.Add(defaultTokenTTL[tokenType]),
+	}
+
+	if err := tx.Create(token); err != nil {
+		return nil, "", errors.Wrap(err, "error creating token")
+	}
+
+	return token, plaintext, nil
+}
+
+// CreateTokenWithChallenge is CreateToken plus an optional PKCE
+// code_challenge. When codeChallenge is non-empty, redemption of the
+// resulting token requires a matching code_verifier (see
+// Token.VerifyChallenge) and the flow is recorded as FlowPKCE so the
+// redemption endpoint knows to hand back an auth code instead of a session.
+func CreateTokenWithChallenge(tx *storage.Connection, userID uuid.UUID, tokenType TokenType, payload interface{}, codeChallenge string) (*Token, string, error) {
+	token, plaintext, err := CreateToken(tx, userID, tokenType, payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if codeChallenge == "" {
+		return token, plaintext, nil
+	}
+
+	token.FlowType = FlowPKCE
+	token.CodeChallenge = &codeChallenge
+	if err := tx.UpdateOnly(token, "flow_type", "code_challenge"); err != nil {
+		return nil, "", errors.Wrap(err, "error saving code challenge")
+	}
+
+	return token, plaintext, nil
+}
+
+// VerifyChallenge checks a PKCE code_verifier against the token's stored
+// code_challenge (S256 only: base64url(sha256(verifier)) == challenge). If
+// the token was issued without a challenge, any verifier (including none)
+// is accepted, preserving backwards compatibility with the implicit flow.
+func (t *Token) VerifyChallenge(codeVerifier string) bool {
+	if t.CodeChallenge == nil {
+		return true
+	}
+
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:]) == *t.CodeChallenge
+}
+
+// randomNonce generates a zero-padded 6-digit numeric code, suitable for a
+// user to type in rather than click a link.
+func randomNonce() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	n := (uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])) % 1000000
+	return fmt.Sprintf("%06d", n), nil
+}
+
+// CreateNonce issues and persists a short numeric token, as used by the
+// reauthentication flow where the user types the code back in rather than
+// following a link.
+func CreateNonce(tx *storage.Connection, userID uuid.UUID, tokenType TokenType) (*Token, string, error) {
+	plaintext, err := randomNonce()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "error generating nonce")
+	}
+
+	now := time.Now()
+	token := &Token{
+		ID:        uuid.Must(uuid.NewV4()),
+		TokenHash: hashToken(plaintext),
+		Type:      tokenType,
+		UserID:    userID,
+		FlowType:  FlowImplicit,
+		CreatedAt: now,
+		ExpiresAt: now.Add(defaultTokenTTL[tokenType]),
+	}
+
+	if err := tx.Create(token); err != nil {
+		return nil, "", errors.Wrap(err, "error creating nonce")
+	}
+
+	return token, plaintext, nil
+}
+
+// LatestToken returns the most recently issued token of tokenType for
+// user, regardless of whether it has since been used or expired. Mail
+// senders use this to rate-limit repeat sends the way the legacy
+// users.*SentAt columns used to, without needing a column of their own.
+func LatestToken(tx *storage.Connection, userID uuid.UUID, tokenType TokenType) (*Token, error) {
+	token := &Token{}
+	err := tx.Where("user_id = ? and type = ?", userID, tokenType).Order("created_at desc").First(token)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, TokenNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "error finding latest token")
+	}
+	return token, nil
+}
+
+// FindTokenByPlaintext looks a token up by hashing plaintext and matching it
+// against the stored hash. It returns TokenNotFoundError if no unused token
+// of tokenType matches. Expired tokens are still returned; callers check
+// IsExpired themselves.
+func FindTokenByPlaintext(tx *storage.Connection, tokenType TokenType, plaintext string) (*Token, error) {
+	token := &Token{}
+	err := tx.Where("token_hash = ? and type = ? and used_at is null", hashToken(plaintext), tokenType).First(token)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, TokenNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "error finding token")
+	}
+	return token, nil
+}
+
+// IsExpired reports whether the token's TTL has elapsed.
+func (t *Token) IsExpired() bool {
+	return time.Now().After(t.ExpiresAt)
+}
+
+// Consume atomically marks the token as used so it cannot be redeemed a
+// second time: the update only applies if used_at is still null, so of two
+// concurrent redemptions exactly one wins. Callers should do this inside
+// the same transaction that applies the token's side effect, and treat a
+// TokenNotFoundError as "already consumed" rather than an internal error.
+func (t *Token) Consume(tx *storage.Connection) error {
+	now := time.Now()
+	count, err := tx.RawQuery("update tokens set used_at = ? where id = ? and used_at is null", now, t.ID).ExecWithCount()
+	if err != nil {
+		return errors.Wrap(err, "error consuming token")
+	}
+	if count == 0 {
+		return TokenNotFoundError{}
+	}
+	t.UsedAt = &now
+	return nil
+}
+
+// PurgeExpiredTokens deletes tokens past their expiry. It is intended to be
+// run periodically by a maintenance goroutine rather than on the request
+// path.
+func PurgeExpiredTokens(tx *storage.Connection) error {
+	return tx.RawQuery("delete from tokens where expires_at < ?", time.Now()).Exec()
+}
@@ -0,0 +1,191 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/netlify/gotrue/storage"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type TokenTestSuite struct {
+	suite.Suite
+	db *storage.Connection
+}
+
+func TestToken(t *testing.T) {
+	ts := &TokenTestSuite{db: db}
+	suite.Run(t, ts)
+}
+
+func (ts *TokenTestSuite) SetupTest() {
+	ts.Require().NoError(ts.db.RawQuery("delete from tokens").Exec())
+}
+
+// TestConsumeIsAtomic guards against double-redemption: of two concurrent
+// Consume calls racing against the same token, exactly one must succeed.
+func (ts *TokenTestSuite) TestConsumeIsAtomic() {
+	userID := uuid.Must(uuid.NewV4())
+	token, plaintext, err := CreateToken(ts.db, userID, RecoveryToken, nil)
+	ts.Require().NoError(err)
+	ts.Require().NotEmpty(plaintext)
+
+	const races = 10
+	var wg sync.WaitGroup
+	successes := make([]bool, races)
+	for i := 0; i < races; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fresh, err := FindTokenByPlaintext(ts.db, RecoveryToken, plaintext)
+			if err != nil {
+				return
+			}
+			successes[i] = fresh.Consume(ts.db) == nil
+		}(i)
+	}
+	wg.Wait()
+
+	wins := 0
+	for _, ok := range successes {
+		if ok {
+			wins++
+		}
+	}
+	ts.Equal(1, wins, "exactly one concurrent Consume should win the race")
+
+	reloaded, err := FindTokenByPlaintext(ts.db, RecoveryToken, plaintext)
+	ts.Equal(TokenNotFoundError{}, err)
+	ts.Nil(reloaded)
+	_ = token
+}
+
+// TestCreateTokenWithChallengeAppliesToEmailChange guards PKCE support on
+// the email-change path specifically, not just recovery: a token issued
+// for EmailChangeToken with a non-empty codeChallenge must come back as
+// FlowPKCE with the challenge persisted, the same way it does for
+// RecoveryToken.
+func (ts *TokenTestSuite) TestCreateTokenWithChallengeAppliesToEmailChange() {
+	userID := uuid.Must(uuid.NewV4())
+
+	token, _, err := CreateTokenWithChallenge(ts.db, userID, EmailChangeToken, map[string]interface{}{"new_email": "new@example.com"}, "a-challenge")
+	ts.Require().NoError(err)
+	ts.Equal(FlowPKCE, token.FlowType)
+	ts.Require().NotNil(token.CodeChallenge)
+	ts.Equal("a-challenge", *token.CodeChallenge)
+
+	implicit, _, err := CreateTokenWithChallenge(ts.db, userID, EmailChangeToken, nil, "")
+	ts.Require().NoError(err)
+	ts.Equal(FlowImplicit, implicit.FlowType)
+	ts.Nil(implicit.CodeChallenge)
+}
+
+// TestTokenHashUniquenessIsScopedByType guards against the tokens table's
+// unique index being narrowed back to token_hash alone. Reauthentication
+// nonces are only 6 digits, so two different users' nonces collide on
+// token_hash far more often than two 256-bit bearer tokens ever would; if
+// the index isn't scoped to (type, token_hash), an uninvolved user's
+// CreateNonce/CreateToken call fails with a raw unique-constraint error
+// whenever that happens.
+func (ts *TokenTestSuite) TestTokenHashUniquenessIsScopedByType() {
+	now := time.Now()
+	base := Token{
+		TokenHash: hashToken("collision"),
+		UserID:    uuid.Must(uuid.NewV4()),
+		FlowType:  FlowImplicit,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	}
+
+	recovery := base
+	recovery.ID = uuid.Must(uuid.NewV4())
+	recovery.Type = RecoveryToken
+	ts.Require().NoError(ts.db.Create(&recovery))
+
+	// Same token_hash, different type and user: must NOT collide.
+	reauth := base
+	reauth.ID = uuid.Must(uuid.NewV4())
+	reauth.UserID = uuid.Must(uuid.NewV4())
+	reauth.Type = ReauthenticationToken
+	ts.Require().NoError(ts.db.Create(&reauth))
+
+	// Same token_hash AND same type: must still collide.
+	dupe := base
+	dupe.ID = uuid.Must(uuid.NewV4())
+	dupe.Type = RecoveryToken
+	ts.Error(ts.db.Create(&dupe))
+}
+
+// TestEmailChangeAndConfirmationRoundTrip guards the part of the reset/
+// email-change/confirm migration that has no other direct test: that
+// CreateToken/FindTokenByPlaintext/Consume work the same way for
+// EmailChangeToken and ConfirmationToken as they do for RecoveryToken, now
+// that sendEmailChange, sendSecureEmailChange and sendConfirmation all
+// issue through the shared token store instead of the old users.*Token
+// columns.
+func (ts *TokenTestSuite) TestEmailChangeAndConfirmationRoundTrip() {
+	for _, tokenType := range []TokenType{EmailChangeToken, ConfirmationToken} {
+		userID := uuid.Must(uuid.NewV4())
+
+		_, plaintext, err := CreateToken(ts.db, userID, tokenType, map[string]interface{}{"new_email": "new@example.com"})
+		ts.Require().NoError(err)
+
+		found, err := FindTokenByPlaintext(ts.db, tokenType, plaintext)
+		ts.Require().NoError(err)
+		ts.Equal(userID, found.UserID)
+
+		ts.Require().NoError(found.Consume(ts.db))
+
+		_, err = FindTokenByPlaintext(ts.db, tokenType, plaintext)
+		ts.Equal(TokenNotFoundError{}, err, "a consumed token must no longer be findable")
+	}
+}
+
+// TestLatestTokenRateLimitsResend guards the mail senders' resend throttle:
+// LatestToken must return the most recently issued token of the right type
+// so a second Recover call within maxFrequency can tell there's already one
+// outstanding, rather than minting (and emailing) an unbounded number of
+// recovery tokens for the same user.
+func (ts *TokenTestSuite) TestLatestTokenRateLimitsResend() {
+	userID := uuid.Must(uuid.NewV4())
+
+	_, err := LatestToken(ts.db, userID, RecoveryToken)
+	ts.Equal(TokenNotFoundError{}, err)
+
+	older, _, err := CreateToken(ts.db, userID, RecoveryToken, nil)
+	ts.Require().NoError(err)
+
+	newer, _, err := CreateToken(ts.db, userID, RecoveryToken, nil)
+	ts.Require().NoError(err)
+
+	latest, err := LatestToken(ts.db, userID, RecoveryToken)
+	ts.Require().NoError(err)
+	ts.Equal(newer.ID, latest.ID)
+	ts.NotEqual(older.ID, latest.ID)
+
+	// A token of a different type for the same user must not satisfy the
+	// lookup — each flow's resend throttle is independent.
+	_, err = LatestToken(ts.db, userID, ConfirmationToken)
+	ts.Equal(TokenNotFoundError{}, err)
+}
+
+// TestVerifyChallengeRejectsMismatch guards the PKCE auth-code handoff: a
+// code minted with CreateTokenWithChallenge must reject every verifier
+// except the one matching its challenge.
+func TestVerifyChallengeRejectsMismatch(t *testing.T) {
+	challenge := "abc123"
+	token := &Token{CodeChallenge: &challenge}
+
+	require.False(t, token.VerifyChallenge("wrong-verifier"))
+
+	sum := sha256.Sum256([]byte("correct-verifier"))
+	matching := &Token{CodeChallenge: stringPtr(base64.RawURLEncoding.EncodeToString(sum[:]))}
+	require.True(t, matching.VerifyChallenge("correct-verifier"))
+}
+
+func stringPtr(s string) *string { return &s }